@@ -0,0 +1,58 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Socket options the syscall package does not export
+const (
+	ipv6BoundIf  = 0x7d // IPV6_BOUND_IF
+	ipDontFrag   = 28   // IP_DONTFRAG
+	ipv6DontFrag = 62   // IPV6_DONTFRAG
+)
+
+// bindToInterface restricts fd to sending through the named interface
+// (IP_BOUND_IF / IPV6_BOUND_IF)
+func bindToInterface(fd int, ipv6 bool, ifname string) error {
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6BoundIf, ifi.Index)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+}
+
+// setDontFragment sets the Don't-Fragment bit on packets sent from fd, so
+// oversized probes are refused rather than fragmented (IP_DONTFRAG /
+// IPV6_DONTFRAG)
+func setDontFragment(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, ipDontFrag, 1)
+}
+
+// errNoRecvErr explains why the unprivileged traceroute fallback is missing
+var errNoRecvErr = errors.New("UDP traceroute needs IP_RECVERR, which is Linux only; run with sudo for raw ICMP")
+
+// enableRecvErr is Linux only; macOS cannot read ICMP errors on a UDP socket
+func enableRecvErr(fd int, ipv6 bool) error {
+	return errNoRecvErr
+}
+
+// readICMPError is Linux only, see enableRecvErr
+func readICMPError(fd int, ipv6 bool) (from net.IP, icmpType, icmpCode uint8, err error) {
+	return nil, 0, 0, errNoRecvErr
+}
+
+// pingGroupRangeHint is Linux only; macOS allows unprivileged ICMP sockets
+// without a sysctl
+func pingGroupRangeHint(err error) string {
+	return ""
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// sock_extended_err origins for errors reported by ICMP / ICMPv6 messages
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// bindToInterface restricts fd to sending and receiving through the named
+// interface (SO_BINDTODEVICE; needs CAP_NET_RAW on kernels before 5.7)
+func bindToInterface(fd int, ipv6 bool, ifname string) error {
+	return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+}
+
+// setDontFragment sets the Don't-Fragment bit on packets sent from fd, so
+// oversized probes are refused rather than fragmented (IP_MTU_DISCOVER /
+// IPV6_MTU_DISCOVER with PMTUDISC_DO)
+func setDontFragment(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+}
+
+// enableRecvErr queues the ICMP errors a datagram socket receives
+// (IP_RECVERR / IPV6_RECVERR), so readICMPError can see which router sent
+// them without a raw socket
+func enableRecvErr(fd int, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.SOL_IPV6, syscall.IPV6_RECVERR, 1)
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVERR, 1)
+}
+
+// readICMPError takes one ICMP error off fd's error queue and returns the
+// address that sent it with its type and code. It returns EAGAIN when the
+// queue is empty.
+func readICMPError(fd int, ipv6 bool) (from net.IP, icmpType, icmpCode uint8, err error) {
+	buf := make([]byte, 1500)
+	oob := make([]byte, 512)
+	_, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_ERRQUEUE)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	for _, msg := range msgs {
+		if !(msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVERR) &&
+			!(msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == syscall.IPV6_RECVERR) {
+			continue
+		}
+
+		// struct sock_extended_err (16 bytes), then the offender's sockaddr
+		data := msg.Data
+		if len(data) < 16 || (data[4] != soEEOriginICMP && data[4] != soEEOriginICMP6) {
+			continue
+		}
+		icmpType, icmpCode = data[5], data[6]
+		offender := data[16:]
+		if ipv6 && len(offender) >= 24 {
+			from = append(net.IP(nil), offender[8:24]...)
+		} else if !ipv6 && len(offender) >= 8 {
+			from = net.IPv4(offender[4], offender[5], offender[6], offender[7])
+		}
+		return from, icmpType, icmpCode, nil
+	}
+	return nil, 0, 0, errors.New("no ICMP error in the socket error queue")
+}
+
+// pingGroupRangeHint explains a permission error from an unprivileged ICMP
+// socket: Linux only hands those to groups inside net.ipv4.ping_group_range,
+// which also covers ICMPv6. It returns "" if err is not a permission error or
+// the range already includes one of the user's groups
+func pingGroupRangeHint(err error) string {
+	if !errors.Is(err, syscall.EACCES) && !errors.Is(err, syscall.EPERM) {
+		return ""
+	}
+	data, readErr := os.ReadFile("/proc/sys/net/ipv4/ping_group_range")
+	if readErr != nil {
+		return ""
+	}
+	var low, high int
+	if _, scanErr := fmt.Sscan(string(data), &low, &high); scanErr != nil {
+		return ""
+	}
+
+	gid := os.Getegid()
+	groups, _ := os.Getgroups()
+	for _, g := range append(groups, gid) {
+		if g >= low && g <= high {
+			return ""
+		}
+	}
+
+	// Widen the range to take in gid, or open just gid if it is empty
+	if low > high {
+		low, high = gid, gid
+	} else {
+		low, high = min(low, gid), max(high, gid)
+	}
+	return fmt.Sprintf("Unprivileged ICMP sockets are limited to groups in net.ipv4.ping_group_range (%s), which excludes your group %d; allow them with: sudo sysctl -w net.ipv4.ping_group_range=\"%d %d\"",
+		strings.Join(strings.Fields(string(data)), " "), gid, low, high)
+}
@@ -90,6 +90,23 @@ run_json_test() {
     fi
 }
 
+# Print the largest gap between consecutive -ndjson probe records (read on
+# stdin) as "max gap Nms"
+max_probe_gap_ms() {
+    python3 -c '
+import json, re, sys
+times = []
+for line in sys.stdin:
+    rec = json.loads(line)
+    if rec.get("type") != "probe":
+        continue
+    h, m, s = re.search(r"T(\d+):(\d+):([\d.]+)", rec["timestamp"]).groups()
+    times.append(int(h) * 3600 + int(m) * 60 + float(s))
+print("max gap %dms" % max((b - a) * 1000 for a, b in zip(times, times[1:])))
+'
+}
+export -f max_probe_gap_ms
+
 echo "======================================"
 echo "ProtoTester Unit Test Suite"
 echo "======================================"
@@ -157,6 +174,10 @@ run_json_test "JSON UDP mode" "go run . -u -json -4only -c 2"
 run_json_test "JSON DNS mode" "go run . -dns -json -4only -c 2"
 run_json_test "JSON HTTP mode" "go run . -http -p 80 -4 google.com -json -c 2"
 run_json_test "JSON compare mode" "go run . -compare google.com -json -c 2" 30
+run_json_test "JSON via -format" "go run . -format json -4 127.0.0.1 -4only -p 9 -c 2 -i 10ms 2>/tmp/unittest_stderr.tmp; grep -q 'exit status 2' /tmp/unittest_stderr.tmp"
+run_test "CSV output" "go run . -format csv -4 127.0.0.1 -4only -p 9 -c 2 -i 10ms 2>/tmp/unittest_stderr.tmp; grep -q 'exit status 2' /tmp/unittest_stderr.tmp" "^timestamp,mode,protocol,family,target,port"
+run_test "Prometheus output" "go run . -format prometheus -4 127.0.0.1 -4only -p 9 -c 2 -i 10ms 2>/tmp/unittest_stderr.tmp; grep -q 'exit status 2' /tmp/unittest_stderr.tmp" "^prototester_probes_sent{.*family=\"ipv4\""
+run_test "Invalid format error" "go run . -format xml 2>&1 || true" "format must be"
 
 echo
 
@@ -182,13 +203,41 @@ echo
 echo -e "${YELLOW}=== Edge Case Tests ===${NC}"
 
 run_test "Very short test count" "go run . -4only -c 1" "1 sent"
-run_test "DNS with custom port" "go run . -dns -p 8053 -4only -c 2" "8053"
-run_test "HTTP with custom port" "go run . -http -p 8080 -4 httpbin.org -c 2" "8080" 15
+# Nothing answers on these ports, so the run must also exit 2 (unreachable)
+run_test "DNS with custom port" "go run . -dns -p 8053 -4only -c 2 2>&1 | tee /dev/stderr | grep -q 'exit status 2'" "8053" 15
+run_test "HTTP with custom port" "go run . -http -p 8080 -4 127.0.0.1 -4only -c 2 2>&1 | tee /dev/stderr | grep -q 'exit status 2'" "8080" 15
+
+echo
+
+# Exit code tests (go run reports the program's status as "exit status N")
+echo -e "${YELLOW}=== Exit Code Tests ===${NC}"
+
+run_test "Exit code when unreachable" "go run . -4 127.0.0.1 -p 9 -c 1 -i 10ms 2>&1 || true" "exit status 2"
+run_test "Invalid fail-under error" "go run . -fail-under 150 2>&1 || true" "fail-under must be"
+
+echo
+
+# Probes to a blackholed address each take the full timeout; they must
+# still be sent one interval apart rather than interval + timeout
+echo -e "${YELLOW}=== Pacing Tests ===${NC}"
+
+run_test "Fixed-rate pacing with slow probes" "go run . -4 192.0.2.1 -c 4 -i 500ms -timeout 300ms -no-preflight -ndjson 2>/dev/null | max_probe_gap_ms" "max gap [45][0-9][0-9]ms" 15
+
+echo
+
+# Loopback averages are sub-millisecond; the scores must stay finite (an
+# infinite score cannot be encoded as JSON at all)
+echo -e "${YELLOW}=== Loopback Score Tests ===${NC}"
+
+run_test "Finite scores on 127.0.0.1/::1" "go run . -compare localhost -icmp -c 3 -i 10ms -json | grep -cE '\"ipv[46]_score\": [0-9.e+-]+,?\$'" "^2\$"
+
+# Per-definition jitter is in milliseconds, so loopback values are tiny
+run_test "Jitter in milliseconds on 127.0.0.1" "go run . -icmp -4 127.0.0.1 -4only -c 5 -i 10ms -json 2>/dev/null | awk '/^{/,0' | python3 -c 'import json, sys; s = json.load(sys.stdin)[\"ipv4_results\"]; print(\"jitter ok\" if all(0 < s.get(k, -1) < 100 for k in (\"jitter_madev_ms\", \"jitter_rfc3550_ms\", \"jitter_stddev_ms\")) else s)'" "jitter ok"
 
 echo
 
 # Cleanup
-rm -f /tmp/unittest_output.tmp /tmp/unittest_json.tmp /tmp/unittest_json_only.tmp
+rm -f /tmp/unittest_output.tmp /tmp/unittest_json.tmp /tmp/unittest_json_only.tmp /tmp/unittest_stderr.tmp
 
 # Final summary
 echo "======================================"